@@ -0,0 +1,41 @@
+package headscale
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// routeFailoverCheckInterval is how often checkRouteFailovers re-evaluates whether the
+// current primary subnet router for each advertised prefix is still reachable.
+const routeFailoverCheckInterval = 30 * time.Second
+
+// watchRouteFailovers loops forever, periodically promoting a new primary subnet
+// router for any prefix whose current primary has gone offline, until ctx is cancelled.
+// grace is h.cfg.RouteFailoverGrace, a short (minutes-scale) grace period dedicated to
+// this check — it must not be confused with the much longer machine-registration expiry.
+func (h *Headscale) watchRouteFailovers(ctx context.Context, grace time.Duration) {
+	ticker := time.NewTicker(routeFailoverCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.checkRouteFailovers(grace); err != nil {
+				log.Error().Err(err).Msg("Failed to check route failovers")
+			}
+		}
+	}
+}
+
+// StartBackgroundJobs launches every periodic maintenance goroutine Headscale relies
+// on: the ephemeral machine reaper and the subnet-router failover watcher. It should be
+// called once, from wherever the gRPC/HTTP servers are started, and stopped by
+// cancelling ctx.
+func (h *Headscale) StartBackgroundJobs(ctx context.Context) {
+	go h.expireEphemeralMachines(ctx, h.cfg.EphemeralMachineGrace)
+	go h.watchRouteFailovers(ctx, h.cfg.RouteFailoverGrace)
+}
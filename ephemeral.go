@@ -0,0 +1,65 @@
+package headscale
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ephemeralGarbageCollectorInterval is how often expireEphemeralMachines wakes up to
+// scan for ephemeral machines that have disconnected.
+const ephemeralGarbageCollectorInterval = 30 * time.Second
+
+// expireEphemeralMachines loops forever, removing any machine that was registered with
+// an ephemeral PreAuthKey and has not been seen for longer than grace, until ctx is
+// cancelled. It is started by Headscale.StartBackgroundJobs.
+func (h *Headscale) expireEphemeralMachines(ctx context.Context, grace time.Duration) {
+	ticker := time.NewTicker(ephemeralGarbageCollectorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.reapEphemeralMachines(grace); err != nil {
+				log.Error().Err(err).Msg("Failed to reap ephemeral machines")
+			}
+		}
+	}
+}
+
+// reapEphemeralMachines hard deletes every ephemeral machine that has gone unseen for
+// longer than grace, and notifies their namespace's remaining peers of the change. A
+// machine that registered but has never completed a map poll (LastSeen is still nil)
+// is timed from its CreatedAt instead, so it is eventually reaped rather than kept
+// forever.
+func (h *Headscale) reapEphemeralMachines(grace time.Duration) error {
+	machines := []Machine{}
+	if err := h.db.Where("ephemeral = ?", true).Find(&machines).Error; err != nil {
+		return err
+	}
+
+	cutoff := time.Now().UTC().Add(-grace)
+
+	for index := range machines {
+		machine := machines[index]
+
+		lastActivity := machine.lastActivity()
+		if lastActivity.After(cutoff) {
+			continue
+		}
+
+		log.Info().
+			Str("machine", machine.Name).
+			Time("last_activity", lastActivity).
+			Msg("Reaping disconnected ephemeral machine")
+
+		if err := h.HardDeleteMachine(&machine); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
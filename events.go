@@ -0,0 +1,181 @@
+package headscale
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/rs/zerolog/log"
+)
+
+// EventType identifies the kind of machine lifecycle change an Event represents.
+type EventType string
+
+const (
+	EventMachineRegistered  EventType = "machine.registered"
+	EventMachineDeleted     EventType = "machine.deleted"
+	EventMachineHardDeleted EventType = "machine.hard_deleted"
+	EventMachineExpired     EventType = "machine.expired"
+	EventRouteChanged       EventType = "machine.route_changed"
+)
+
+// Event is the payload delivered to every configured sink whenever a machine's
+// lifecycle changes.
+type Event struct {
+	Type      EventType   `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Machine   *v1.Machine `json:"machine"`
+}
+
+// EventSink receives every Event published on the Headscale event bus. Outbound HTTP
+// webhooks (WebhookSink) are the only implementation; NewEventBus builds its sinks from
+// webhook configs alone and takes no other EventSink.
+type EventSink interface {
+	Publish(event Event)
+}
+
+// EventBus fans a published Event out to every configured EventSink.
+type EventBus struct {
+	sinks []EventSink
+}
+
+// NewEventBus builds an EventBus from the `webhooks:` section of the headscale config.
+func NewEventBus(webhooks []WebhookConfig) *EventBus {
+	bus := &EventBus{}
+	for _, webhook := range webhooks {
+		bus.sinks = append(bus.sinks, NewWebhookSink(webhook))
+	}
+
+	return bus
+}
+
+// Publish delivers event to every sink asynchronously. It is safe to call on a nil
+// *EventBus (e.g. when no webhooks are configured), in which case it is a no-op.
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+
+	for _, sink := range b.sinks {
+		go sink.Publish(event)
+	}
+}
+
+// publishEvent publishes an Event for m on h's event bus, if one is configured.
+func (h *Headscale) publishEvent(eventType EventType, m *Machine) {
+	if h.events == nil {
+		return
+	}
+
+	h.events.Publish(Event{
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		Machine:   m.toProto(),
+	})
+}
+
+// WebhookConfig configures a single outbound HTTP webhook sink, as parsed from the
+// `webhooks:` section of the headscale YAML config.
+type WebhookConfig struct {
+	URL    string
+	Secret string
+
+	// MaxRetries is the number of retries to attempt after a failed delivery. Nil means
+	// unset, in which case NewWebhookSink applies webhookDefaultMaxRetries; a configured
+	// 0 is honoured as "never retry", so it must not be conflated with unset.
+	MaxRetries *int
+}
+
+// WebhookSink delivers events as HMAC-SHA256 signed HTTP POST requests, retrying with
+// exponential backoff on failure or a non-2xx response.
+type WebhookSink struct {
+	cfg        WebhookConfig
+	maxRetries int
+	client     *http.Client
+}
+
+const webhookDefaultMaxRetries = 5
+
+// NewWebhookSink builds a WebhookSink for cfg.
+func NewWebhookSink(cfg WebhookConfig) *WebhookSink {
+	maxRetries := webhookDefaultMaxRetries
+	if cfg.MaxRetries != nil {
+		maxRetries = *cfg.MaxRetries
+	}
+
+	return &WebhookSink{
+		cfg:        cfg,
+		maxRetries: maxRetries,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Publish sends event to w.cfg.URL, retrying with exponential backoff up to
+// w.maxRetries times before giving up.
+func (w *WebhookSink) Publish(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Str("url", w.cfg.URL).Msg("Failed to marshal webhook event")
+
+		return
+	}
+
+	signature := w.sign(body)
+	backoff := time.Second
+
+	for attempt := 0; attempt <= w.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		if err := w.deliver(body, signature, event.Type); err != nil {
+			log.Warn().
+				Err(err).
+				Str("url", w.cfg.URL).
+				Int("attempt", attempt+1).
+				Msg("Webhook delivery failed")
+
+			continue
+		}
+
+		return
+	}
+
+	log.Error().Str("url", w.cfg.URL).Msg("Webhook delivery exhausted all retries")
+}
+
+func (w *WebhookSink) deliver(body []byte, signature string, eventType EventType) error {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Headscale-Event", string(eventType))
+	req.Header.Set("X-Headscale-Signature", signature)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded with status %d", w.cfg.URL, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (w *WebhookSink) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.cfg.Secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,90 @@
+package headscale
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+)
+
+func TestWebhookSinkSignIsDeterministicAndSecretDependent(t *testing.T) {
+	body := []byte(`{"type":"machine.registered"}`)
+
+	a := (&WebhookSink{cfg: WebhookConfig{Secret: "s3cr3t"}}).sign(body)
+	b := (&WebhookSink{cfg: WebhookConfig{Secret: "s3cr3t"}}).sign(body)
+	if a != b {
+		t.Errorf("sign() is not deterministic: %q != %q", a, b)
+	}
+
+	c := (&WebhookSink{cfg: WebhookConfig{Secret: "different"}}).sign(body)
+	if a == c {
+		t.Error("sign() with a different secret must produce a different signature")
+	}
+}
+
+func TestNewWebhookSinkMaxRetriesDefaultsWhenUnset(t *testing.T) {
+	sink := NewWebhookSink(WebhookConfig{URL: "http://example.invalid"})
+	if sink.maxRetries != webhookDefaultMaxRetries {
+		t.Errorf("maxRetries = %d, want default %d", sink.maxRetries, webhookDefaultMaxRetries)
+	}
+}
+
+func TestNewWebhookSinkMaxRetriesHonoursExplicitZero(t *testing.T) {
+	zero := 0
+	sink := NewWebhookSink(WebhookConfig{URL: "http://example.invalid", MaxRetries: &zero})
+	if sink.maxRetries != 0 {
+		t.Errorf("an explicit MaxRetries of 0 must be honoured, got %d", sink.maxRetries)
+	}
+}
+
+func TestWebhookSinkPublishMakesExactlyOneAttemptWhenRetriesDisabled(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	zero := 0
+	sink := NewWebhookSink(WebhookConfig{URL: server.URL, Secret: "s3cr3t", MaxRetries: &zero})
+	sink.Publish(Event{Type: EventMachineRegistered, Timestamp: time.Now().UTC(), Machine: &v1.Machine{}})
+
+	if attempts != 1 {
+		t.Errorf("expected exactly 1 attempt with MaxRetries=0, got %d", attempts)
+	}
+}
+
+func TestWebhookSinkDeliverSendsSignedRequest(t *testing.T) {
+	secret := "s3cr3t"
+	body := []byte(`{"type":"machine.registered"}`)
+
+	var gotSignature, gotEventType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSignature = r.Header.Get("X-Headscale-Signature")
+		gotEventType = r.Header.Get("X-Headscale-Event")
+
+		got, err := io.ReadAll(r.Body)
+		if err != nil || string(got) != string(body) {
+			t.Errorf("unexpected request body: %q (err %v)", got, err)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(WebhookConfig{URL: server.URL, Secret: secret})
+
+	if err := sink.deliver(body, sink.sign(body), EventMachineRegistered); err != nil {
+		t.Fatalf("deliver() returned an error: %v", err)
+	}
+
+	if want := sink.sign(body); gotSignature != want {
+		t.Errorf("X-Headscale-Signature = %q, want %q", gotSignature, want)
+	}
+	if gotEventType != string(EventMachineRegistered) {
+		t.Errorf("X-Headscale-Event = %q, want %q", gotEventType, EventMachineRegistered)
+	}
+}
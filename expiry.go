@@ -0,0 +1,96 @@
+package headscale
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// scheduleExpiry (re)schedules the disconnect timer for m based on its current Expiry.
+// It is called whenever a machine registers, is renewed, or is force-expired.
+//
+// Pending timers live on h.pendingExpiries (guarded by h.pendingExpiriesMu), not a
+// package-level map, so they are scoped to a single Headscale instance and cannot leak
+// across the instances spun up by tests or by multiple servers in the same process.
+func (h *Headscale) scheduleExpiry(m *Machine) {
+	h.pendingExpiriesMu.Lock()
+	defer h.pendingExpiriesMu.Unlock()
+
+	if h.pendingExpiries == nil {
+		h.pendingExpiries = make(map[uint64]*time.Timer)
+	}
+
+	if timer, ok := h.pendingExpiries[m.ID]; ok {
+		timer.Stop()
+		delete(h.pendingExpiries, m.ID)
+	}
+
+	if m.Expiry == nil || m.Expiry.IsZero() {
+		return
+	}
+
+	wait := time.Until(*m.Expiry)
+	if wait <= 0 {
+		go h.notifyExpiry(m.ID, m.NamespaceID)
+
+		return
+	}
+
+	machineID := m.ID
+	namespaceID := m.NamespaceID
+	h.pendingExpiries[m.ID] = time.AfterFunc(wait, func() {
+		h.notifyExpiry(machineID, namespaceID)
+	})
+}
+
+// notifyExpiry pushes an immediate map update for namespaceID, so machineID's expiry
+// (MachineAuthorized=false, KeyExpiry in the past) is reflected to it and to its peers,
+// removing it from their AllowedIPs.
+func (h *Headscale) notifyExpiry(machineID uint64, namespaceID uint) {
+	h.pendingExpiriesMu.Lock()
+	delete(h.pendingExpiries, machineID)
+	h.pendingExpiriesMu.Unlock()
+
+	if m, err := h.GetMachineByID(machineID); err == nil {
+		h.publishEvent(EventMachineExpired, m)
+	}
+
+	if err := h.RequestMapUpdates(namespaceID); err != nil {
+		log.Error().
+			Err(err).
+			Uint64("machine", machineID).
+			Msg("Failed to push map update for expired machine")
+	}
+}
+
+// ExpireMachine immediately expires m, disconnecting it and removing it from its
+// peers' view on their next map update.
+func (h *Headscale) ExpireMachine(m *Machine) error {
+	now := time.Now().UTC()
+	m.Expiry = &now
+
+	if err := h.db.Save(m).Error; err != nil {
+		return err
+	}
+
+	// scheduleExpiry sees the now-past Expiry and fires notifyExpiry immediately, which
+	// publishes EventMachineExpired and pushes the map update, so we don't do it twice here.
+	h.scheduleExpiry(m)
+
+	return nil
+}
+
+// RenewMachine extends m's Expiry by duration from now and reschedules its disconnect timer.
+func (h *Headscale) RenewMachine(m *Machine, duration time.Duration) error {
+	expiry := time.Now().UTC().Add(duration)
+	m.Expiry = &expiry
+	m.RequestedExpiry = &expiry
+
+	if err := h.db.Save(m).Error; err != nil {
+		return err
+	}
+
+	h.scheduleExpiry(m)
+
+	return h.RequestMapUpdates(m.NamespaceID)
+}
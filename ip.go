@@ -0,0 +1,79 @@
+package headscale
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"inet.af/netaddr"
+)
+
+// getAvailableIPs finds the next available IPv4 address from h.cfg.IPPrefix and, if
+// an IPv6 ULA prefix is configured via h.cfg.IPv6Prefix, the next available IPv6
+// address from it, returning a dual-stack MachineAddresses for the new machine.
+func (h *Headscale) getAvailableIPs() (MachineAddresses, error) {
+	ips := MachineAddresses{}
+
+	ip, err := h.getAvailableIPInPrefix(h.cfg.IPPrefix)
+	if err != nil {
+		return nil, err
+	}
+	ips = append(ips, ip)
+
+	if !h.cfg.IPv6Prefix.IsZero() {
+		ip6, err := h.getAvailableIPInPrefix(h.cfg.IPv6Prefix)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip6)
+	}
+
+	return ips, nil
+}
+
+// getAvailableIPInPrefix finds the first unused IP address within prefix, skipping
+// the network and broadcast addresses and any address already assigned to a machine.
+func (h *Headscale) getAvailableIPInPrefix(prefix netaddr.IPPrefix) (netaddr.IP, error) {
+	usedIPs, err := h.getUsedIPs()
+	if err != nil {
+		return netaddr.IP{}, err
+	}
+
+	ipBuilder := prefix.Range().From()
+	lastIP := prefix.Range().To()
+
+	for ip := ipBuilder.Next(); ip.Less(lastIP); ip = ip.Next() {
+		if containsIP(usedIPs, ip) {
+			continue
+		}
+
+		return ip, nil
+	}
+
+	return netaddr.IP{}, fmt.Errorf("no more IPs available in prefix %s", prefix)
+}
+
+// getUsedIPs returns every IP address already assigned to a machine, across both
+// address families, so a fresh registration does not collide with it.
+func (h *Headscale) getUsedIPs() ([]netaddr.IP, error) {
+	machines := []Machine{}
+	if err := h.db.Unscoped().Find(&machines).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	usedIPs := make([]netaddr.IP, 0, len(machines))
+	for _, machine := range machines {
+		usedIPs = append(usedIPs, machine.IPAddresses...)
+	}
+
+	return usedIPs, nil
+}
+
+func containsIP(ips []netaddr.IP, ip netaddr.IP) bool {
+	for _, candidate := range ips {
+		if candidate == ip {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,6 +1,7 @@
 package headscale
 
 import (
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,13 +21,79 @@ import (
 	"tailscale.com/types/wgkey"
 )
 
+// MachineAddresses is a list of IP addresses assigned to a Machine, typically
+// one IPv4 address from the configured IPPrefix and one IPv6 address from
+// the configured IPv6Prefix, stored as a comma separated string in the database.
+type MachineAddresses []netaddr.IP
+
+func (ma MachineAddresses) ToStringSlice() []string {
+	strSlice := make([]string, 0, len(ma))
+	for _, addr := range ma {
+		strSlice = append(strSlice, addr.String())
+	}
+
+	return strSlice
+}
+
+func (ma *MachineAddresses) Scan(destination interface{}) error {
+	switch value := destination.(type) {
+	case nil:
+		*ma = nil
+
+		return nil
+
+	case string:
+		return ma.scanString(value)
+
+	case []byte:
+		return ma.scanString(string(value))
+
+	default:
+		return fmt.Errorf("unexpected data type %T", destination)
+	}
+}
+
+func (ma *MachineAddresses) scanString(value string) error {
+	if value == "" {
+		*ma = nil
+
+		return nil
+	}
+
+	addrs := strings.Split(value, ",")
+	*ma = make(MachineAddresses, len(addrs))
+	for index, addr := range addrs {
+		ip, err := netaddr.ParseIP(addr)
+		if err != nil {
+			return fmt.Errorf("failed to parse IP address in MachineAddresses: %w", err)
+		}
+
+		(*ma)[index] = ip
+	}
+
+	return nil
+}
+
+// Value returns the comma separated string representation for gorm to store in the database.
+func (ma MachineAddresses) Value() (driver.Value, error) {
+	addrs := strings.Join(ma.ToStringSlice(), ",")
+
+	return addrs, nil
+}
+
+// GormDataType tells gorm what column type to use for a MachineAddresses field, since it
+// cannot be inferred from the underlying []netaddr.IP.
+func (ma MachineAddresses) GormDataType() string {
+	return "text"
+}
+
 // Machine is a Headscale client.
 type Machine struct {
 	ID          uint64 `gorm:"primary_key"`
 	MachineKey  string `gorm:"type:varchar(64);unique_index"`
 	NodeKey     string
 	DiscoKey    string
-	IPAddress   string
+	IPAddresses MachineAddresses
 	Name        string
 	NamespaceID uint
 	Namespace   Namespace `gorm:"foreignKey:NamespaceID"`
@@ -35,15 +102,16 @@ type Machine struct {
 	RegisterMethod string
 	AuthKeyID      uint
 	AuthKey        *PreAuthKey
+	Ephemeral      bool // true if the machine was registered with an ephemeral PreAuthKey
 
 	LastSeen             *time.Time
 	LastSuccessfulUpdate *time.Time
 	Expiry               *time.Time
 	RequestedExpiry      *time.Time
 
-	HostInfo      datatypes.JSON
-	Endpoints     datatypes.JSON
-	EnabledRoutes datatypes.JSON
+	HostInfo   datatypes.JSON
+	Endpoints  datatypes.JSON
+	ForcedTags datatypes.JSON // admin-assigned ACL tags, always applied regardless of HostInfo.RequestTags
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
@@ -62,13 +130,28 @@ func (m Machine) isAlreadyRegistered() bool {
 
 // isExpired returns whether the machine registration has expired.
 func (m Machine) isExpired() bool {
+	if m.Expiry == nil || m.Expiry.IsZero() {
+		return false
+	}
+
 	return time.Now().UTC().After(*m.Expiry)
 }
 
+// lastActivity returns the last time m was known to be connected. A machine that has
+// registered but not yet completed a single map poll has a nil LastSeen; callers that
+// use this to decide staleness (the ephemeral reaper, route failover) must treat that
+// case as "seen at CreatedAt", not as "never seen" / "already stale".
+func (m Machine) lastActivity() time.Time {
+	if m.LastSeen != nil {
+		return *m.LastSeen
+	}
+
+	return m.CreatedAt
+}
+
 // If the Machine is expired, updateMachineExpiry updates the Machine Expiry time to the maximum allowed duration,
-// or the default duration if no Expiry time was requested by the client. The expiry time here does not (yet) cause
-// a client to be disconnected, however they will have to re-auth the machine if they attempt to reconnect after the
-// expiry time.
+// or the default duration if no Expiry time was requested by the client. Once the new Expiry time is reached, the
+// map-poll path (see expiry.go) disconnects the client and forces it to re-auth the machine before it can reconnect.
 func (h *Headscale) updateMachineExpiry(m *Machine) {
 	if m.isExpired() {
 		now := time.Now().UTC()
@@ -93,6 +176,7 @@ func (h *Headscale) updateMachineExpiry(m *Machine) {
 		}
 
 		h.db.Save(&m)
+		h.scheduleExpiry(m)
 	}
 }
 
@@ -216,6 +300,14 @@ func (h *Headscale) getPeers(m *Machine) (Machines, error) {
 	peers := append(direct, shared...)
 	peers = append(peers, sharedTo...)
 
+	notExpired := make(Machines, 0, len(peers))
+	for _, peer := range peers {
+		if !peer.isExpired() {
+			notExpired = append(notExpired, peer)
+		}
+	}
+	peers = notExpired
+
 	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
 
 	log.Trace().
@@ -295,6 +387,8 @@ func (h *Headscale) DeleteMachine(m *Machine) error {
 		return err
 	}
 
+	h.publishEvent(EventMachineDeleted, m)
+
 	return h.RequestMapUpdates(namespaceID)
 }
 
@@ -310,6 +404,8 @@ func (h *Headscale) HardDeleteMachine(m *Machine) error {
 		return err
 	}
 
+	h.publishEvent(EventMachineHardDeleted, m)
+
 	return h.RequestMapUpdates(namespaceID)
 }
 
@@ -393,11 +489,13 @@ func (ms Machines) toNodes(
 	baseDomain string,
 	dnsConfig *tailcfg.DNSConfig,
 	includeRoutes bool,
+	primaryRoutes map[uint64][]netaddr.IPPrefix,
+	aclPolicy *ACLPolicy,
 ) ([]*tailcfg.Node, error) {
 	nodes := make([]*tailcfg.Node, len(ms))
 
 	for index, machine := range ms {
-		node, err := machine.toNode(baseDomain, dnsConfig, includeRoutes)
+		node, err := machine.toNode(baseDomain, dnsConfig, includeRoutes, primaryRoutes[machine.ID], aclPolicy)
 		if err != nil {
 			return nil, err
 		}
@@ -409,11 +507,16 @@ func (ms Machines) toNodes(
 }
 
 // toNode converts a Machine into a Tailscale Node. includeRoutes is false for shared nodes
-// as per the expected behaviour in the official SaaS.
+// as per the expected behaviour in the official SaaS. primaryRoutes are the subnets this
+// machine is currently the primary subnet router for, as decided by Headscale.EnableRoute /
+// Headscale.checkRouteFailovers, and are only applied when includeRoutes is true. aclPolicy
+// is used to resolve the machine's ACL tags, see Machine.Tags.
 func (m Machine) toNode(
 	baseDomain string,
 	dnsConfig *tailcfg.DNSConfig,
 	includeRoutes bool,
+	primaryRoutes []netaddr.IPPrefix,
+	aclPolicy *ACLPolicy,
 ) (*tailcfg.Node, error) {
 	nKey, err := wgkey.ParseHex(m.NodeKey)
 	if err != nil {
@@ -436,43 +539,18 @@ func (m Machine) toNode(
 	}
 
 	addrs := []netaddr.IPPrefix{}
-	ip, err := netaddr.ParseIPPrefix(fmt.Sprintf("%s/32", m.IPAddress))
-	if err != nil {
-		log.Trace().
-			Caller().
-			Str("ip", m.IPAddress).
-			Msgf("Failed to parse IP Prefix from IP: %s", m.IPAddress)
-
-		return nil, err
-	}
-	addrs = append(addrs, ip) // missing the ipv6 ?
-
 	allowedIPs := []netaddr.IPPrefix{}
-	allowedIPs = append(
-		allowedIPs,
-		ip,
-	) // we append the node own IP, as it is required by the clients
+	for _, ip := range m.IPAddresses {
+		ipPrefix := netaddr.IPPrefixFrom(ip, ip.BitLen())
+		addrs = append(addrs, ipPrefix)
+		allowedIPs = append(
+			allowedIPs,
+			ipPrefix,
+		) // we append the node own IP(s), as it is required by the clients
+	}
 
 	if includeRoutes {
-		routesStr := []string{}
-		if len(m.EnabledRoutes) != 0 {
-			allwIps, err := m.EnabledRoutes.MarshalJSON()
-			if err != nil {
-				return nil, err
-			}
-			err = json.Unmarshal(allwIps, &routesStr)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		for _, routeStr := range routesStr {
-			ip, err := netaddr.ParseIPPrefix(routeStr)
-			if err != nil {
-				return nil, err
-			}
-			allowedIPs = append(allowedIPs, ip)
-		}
+		allowedIPs = append(allowedIPs, primaryRoutes...)
 	}
 
 	endpoints := []string{}
@@ -539,9 +617,10 @@ func (m Machine) toNode(
 		Hostinfo: hostinfo,
 		Created:  m.CreatedAt,
 		LastSeen: m.LastSeen,
+		Tags:     m.Tags(aclPolicy),
 
 		KeepAlive:         true,
-		MachineAuthorized: m.Registered,
+		MachineAuthorized: m.Registered && !m.isExpired(),
 		Capabilities:      []string{tailcfg.CapabilityFileSharing},
 	}
 
@@ -553,13 +632,15 @@ func (m *Machine) toProto() *v1.Machine {
 		Id:         m.ID,
 		MachineKey: m.MachineKey,
 
-		NodeKey:   m.NodeKey,
-		DiscoKey:  m.DiscoKey,
-		IpAddress: m.IPAddress,
-		Name:      m.Name,
-		Namespace: m.Namespace.toProto(),
+		NodeKey:     m.NodeKey,
+		DiscoKey:    m.DiscoKey,
+		IpAddresses: m.IPAddresses.ToStringSlice(),
+		Name:        m.Name,
+		Namespace:   m.Namespace.toProto(),
 
 		Registered: m.Registered,
+		Ephemeral:  m.Ephemeral,
+		ForcedTags: m.GetForcedTags(),
 
 		// TODO(kradalby): Implement register method enum converter
 		// RegisterMethod: ,
@@ -598,7 +679,7 @@ func (h *Headscale) RegisterMachine(key string, namespace string) (*Machine, err
 	}
 
 	m := Machine{}
-	if result := h.db.First(&m, "machine_key = ?", mKey.HexString()); errors.Is(
+	if result := h.db.Preload("AuthKey").First(&m, "machine_key = ?", mKey.HexString()); errors.Is(
 		result.Error,
 		gorm.ErrRecordNotFound,
 	) {
@@ -621,13 +702,13 @@ func (h *Headscale) RegisterMachine(key string, namespace string) (*Machine, err
 		return nil, err
 	}
 
-	ip, err := h.getAvailableIP()
+	ips, err := h.getAvailableIPs()
 	if err != nil {
 		log.Error().
 			Caller().
 			Err(err).
 			Str("machine", m.Name).
-			Msg("Could not find IP for the new machine")
+			Msg("Could not find IP(s) for the new machine")
 
 		return nil, err
 	}
@@ -635,21 +716,27 @@ func (h *Headscale) RegisterMachine(key string, namespace string) (*Machine, err
 	log.Trace().
 		Caller().
 		Str("machine", m.Name).
-		Str("ip", ip.String()).
-		Msg("Found IP for host")
+		Strs("ips", ips.ToStringSlice()).
+		Msg("Found IP(s) for host")
 
-	m.IPAddress = ip.String()
+	m.IPAddresses = ips
 	m.NamespaceID = ns.ID
 	m.Registered = true
 	m.RegisterMethod = "cli"
+	if m.AuthKey != nil {
+		m.Ephemeral = m.AuthKey.Ephemeral
+	}
 	h.db.Save(&m)
+	h.scheduleExpiry(&m)
 
 	log.Trace().
 		Caller().
 		Str("machine", m.Name).
-		Str("ip", ip.String()).
+		Strs("ips", ips.ToStringSlice()).
 		Msg("Machine registered with the database")
 
+	h.publishEvent(EventMachineRegistered, &m)
+
 	return &m, nil
 }
 
@@ -661,108 +748,3 @@ func (m *Machine) GetAdvertisedRoutes() ([]netaddr.IPPrefix, error) {
 
 	return hostInfo.RoutableIPs, nil
 }
-
-func (m *Machine) GetEnabledRoutes() ([]netaddr.IPPrefix, error) {
-	data, err := m.EnabledRoutes.MarshalJSON()
-	if err != nil {
-		return nil, err
-	}
-
-	routesStr := []string{}
-	err = json.Unmarshal(data, &routesStr)
-	if err != nil {
-		return nil, err
-	}
-
-	routes := make([]netaddr.IPPrefix, len(routesStr))
-	for index, routeStr := range routesStr {
-		route, err := netaddr.ParseIPPrefix(routeStr)
-		if err != nil {
-			return nil, err
-		}
-		routes[index] = route
-	}
-
-	return routes, nil
-}
-
-func (m *Machine) IsRoutesEnabled(routeStr string) bool {
-	route, err := netaddr.ParseIPPrefix(routeStr)
-	if err != nil {
-		return false
-	}
-
-	enabledRoutes, err := m.GetEnabledRoutes()
-	if err != nil {
-		return false
-	}
-
-	for _, enabledRoute := range enabledRoutes {
-		if route == enabledRoute {
-			return true
-		}
-	}
-
-	return false
-}
-
-// EnableNodeRoute enables new routes based on a list of new routes. It will _replace_ the
-// previous list of routes.
-func (h *Headscale) EnableRoutes(m *Machine, routeStrs ...string) error {
-	newRoutes := make([]netaddr.IPPrefix, len(routeStrs))
-	for index, routeStr := range routeStrs {
-		route, err := netaddr.ParseIPPrefix(routeStr)
-		if err != nil {
-			return err
-		}
-
-		newRoutes[index] = route
-	}
-
-	availableRoutes, err := m.GetAdvertisedRoutes()
-	if err != nil {
-		return err
-	}
-
-	for _, newRoute := range newRoutes {
-		if !containsIpPrefix(availableRoutes, newRoute) {
-			return fmt.Errorf(
-				"route (%s) is not available on node %s",
-				m.Name,
-				newRoute,
-			)
-		}
-	}
-
-	routes, err := json.Marshal(newRoutes)
-	if err != nil {
-		return err
-	}
-
-	m.EnabledRoutes = datatypes.JSON(routes)
-	h.db.Save(&m)
-
-	err = h.RequestMapUpdates(m.NamespaceID)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (m *Machine) RoutesToProto() (*v1.Routes, error) {
-	availableRoutes, err := m.GetAdvertisedRoutes()
-	if err != nil {
-		return nil, err
-	}
-
-	enabledRoutes, err := m.GetEnabledRoutes()
-	if err != nil {
-		return nil, err
-	}
-
-	return &v1.Routes{
-		AdvertisedRoutes: ipPrefixToString(availableRoutes),
-		EnabledRoutes:    ipPrefixToString(enabledRoutes),
-	}, nil
-}
@@ -0,0 +1,36 @@
+package headscale
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMachineLastActivity(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-time.Hour)
+	lastSeen := time.Now().UTC().Add(-time.Minute)
+
+	tests := []struct {
+		name    string
+		machine Machine
+		want    time.Time
+	}{
+		{
+			name:    "never polled falls back to CreatedAt",
+			machine: Machine{CreatedAt: createdAt, LastSeen: nil},
+			want:    createdAt,
+		},
+		{
+			name:    "LastSeen set takes priority over CreatedAt",
+			machine: Machine{CreatedAt: createdAt, LastSeen: &lastSeen},
+			want:    lastSeen,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.machine.lastActivity(); !got.Equal(tt.want) {
+				t.Errorf("lastActivity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
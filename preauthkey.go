@@ -0,0 +1,45 @@
+package headscale
+
+import (
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// PreAuthKey is a pre-authentication key which can be used to register a Machine
+// without interactive login. A Machine registered with an Ephemeral PreAuthKey is
+// itself Ephemeral (see Machine.Ephemeral) and is reaped shortly after it disconnects.
+type PreAuthKey struct {
+	ID          uint64 `gorm:"primary_key"`
+	Key         string
+	NamespaceID uint
+	Namespace   Namespace `gorm:"foreignKey:NamespaceID"`
+	Reusable    bool
+	Ephemeral   bool `gorm:"default:false"`
+	Used        bool
+
+	CreatedAt  *time.Time
+	Expiration *time.Time
+}
+
+func (pak *PreAuthKey) toProto() *v1.PreAuthKey {
+	protoKey := &v1.PreAuthKey{
+		Namespace: pak.Namespace.Name,
+		Id:        pak.ID,
+		Key:       pak.Key,
+		Reusable:  pak.Reusable,
+		Ephemeral: pak.Ephemeral,
+		Used:      pak.Used,
+	}
+
+	if pak.Expiration != nil {
+		protoKey.Expiration = timestamppb.New(*pak.Expiration)
+	}
+
+	if pak.CreatedAt != nil {
+		protoKey.CreatedAt = timestamppb.New(*pak.CreatedAt)
+	}
+
+	return protoKey
+}
@@ -0,0 +1,381 @@
+package headscale
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"inet.af/netaddr"
+)
+
+// Route represents a subnet that a Machine advertises (or has been granted permission
+// to route) via Tailscale's subnet router feature. When several machines advertise the
+// same Prefix, only the one with Primary set is included in peers' AllowedIPs; if it
+// goes offline, Headscale.checkRouteFailovers promotes another enabled Route for the
+// same Prefix automatically.
+type Route struct {
+	ID        uint64 `gorm:"primary_key"`
+	MachineID uint64
+	Machine   Machine `gorm:"foreignKey:MachineID"`
+
+	Prefix string `gorm:"type:varchar(43);index"`
+
+	Advertised bool // the machine currently lists this prefix in Hostinfo.RoutableIPs
+	Enabled    bool // an admin has approved routing through this machine for this prefix
+	Primary    bool `gorm:"column:is_primary"` // this route is the one currently handed out to peers
+
+	Metric   int        // lower wins when choosing a Primary among several enabled routes
+	LastSeen *time.Time // when this route was last seen advertised, refreshed by RefreshAdvertisedRoutes
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+var errRouteNotAdvertised = errors.New("route is not advertised by machine")
+
+// IPPrefix parses the stored Prefix back into a netaddr.IPPrefix.
+func (r *Route) IPPrefix() (netaddr.IPPrefix, error) {
+	return netaddr.ParseIPPrefix(r.Prefix)
+}
+
+// GetRoutesForPrefix returns every Route, across all machines, advertising prefix.
+func (h *Headscale) GetRoutesForPrefix(prefix netaddr.IPPrefix) ([]Route, error) {
+	routes := []Route{}
+	if err := h.db.Preload("Machine").Where("prefix = ?", prefix.String()).Find(&routes).Error; err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// GetMachineRoutes returns every Route belonging to m, regardless of Enabled state.
+func (h *Headscale) GetMachineRoutes(m *Machine) ([]Route, error) {
+	routes := []Route{}
+	if err := h.db.Where("machine_id = ?", m.ID).Find(&routes).Error; err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// getOrCreateRoute returns the Route row for m/prefix, creating it (unadvertised and
+// disabled) if it does not exist yet. db is passed in explicitly so callers can run it
+// inside a transaction.
+func getOrCreateRoute(db *gorm.DB, m *Machine, prefix netaddr.IPPrefix) (*Route, error) {
+	route := Route{}
+	err := db.Where("machine_id = ? AND prefix = ?", m.ID, prefix.String()).First(&route).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+
+		route = Route{
+			MachineID: m.ID,
+			Prefix:    prefix.String(),
+		}
+		if err := db.Create(&route).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return &route, nil
+}
+
+// EnableRoute marks prefix as enabled for m. It is promoted to Primary unless another
+// machine is already the enabled Primary for the same prefix. The primary-selection
+// check and its write happen inside a transaction so two concurrent EnableRoute calls
+// for different machines advertising the same prefix cannot both end up Primary.
+func (h *Headscale) EnableRoute(m *Machine, prefix netaddr.IPPrefix) error {
+	advertised, err := m.GetAdvertisedRoutes()
+	if err != nil {
+		return err
+	}
+
+	if !containsIpPrefix(advertised, prefix) {
+		return fmt.Errorf("%w: %s on %s", errRouteNotAdvertised, prefix, m.Name)
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		route, err := getOrCreateRoute(tx, m, prefix)
+		if err != nil {
+			return err
+		}
+
+		others := []Route{}
+		if err := tx.Where("prefix = ?", prefix.String()).Find(&others).Error; err != nil {
+			return err
+		}
+
+		hasPrimary := false
+		for _, other := range others {
+			if other.ID != route.ID && other.Enabled && other.Primary {
+				hasPrimary = true
+
+				break
+			}
+		}
+
+		route.Advertised = true
+		route.Enabled = true
+		route.Primary = !hasPrimary
+
+		return tx.Save(route).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	h.publishEvent(EventRouteChanged, m)
+
+	return h.RequestMapUpdates(m.NamespaceID)
+}
+
+// DisableRoute disables prefix for m. If m was the Primary subnet router for that
+// prefix, another enabled route (if any) is promoted in its place.
+func (h *Headscale) DisableRoute(m *Machine, prefix netaddr.IPPrefix) error {
+	route, err := getOrCreateRoute(h.db, m, prefix)
+	if err != nil {
+		return err
+	}
+
+	wasPrimary := route.Primary
+	route.Enabled = false
+	route.Primary = false
+	if err := h.db.Save(route).Error; err != nil {
+		return err
+	}
+
+	if wasPrimary {
+		if err := h.promoteNextPrimary(prefix, route.ID); err != nil {
+			return err
+		}
+	}
+
+	h.publishEvent(EventRouteChanged, m)
+
+	return h.RequestMapUpdates(m.NamespaceID)
+}
+
+// promoteNextPrimary picks the best enabled route for prefix, other than excludeRouteID,
+// and marks it Primary: lower Metric wins, ties broken by whichever was more recently seen.
+func (h *Headscale) promoteNextPrimary(prefix netaddr.IPPrefix, excludeRouteID uint64) error {
+	routes, err := h.GetRoutesForPrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	var candidate *Route
+	for index := range routes {
+		route := routes[index]
+		if route.ID == excludeRouteID || !route.Enabled {
+			continue
+		}
+
+		if candidate == nil || isBetterPrimary(route, *candidate) {
+			candidate = &routes[index]
+		}
+	}
+
+	if candidate == nil {
+		return nil
+	}
+
+	candidate.Primary = true
+	if err := h.db.Save(candidate).Error; err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("prefix", prefix.String()).
+		Str("machine", candidate.Machine.Name).
+		Msg("Promoted new primary subnet router for prefix")
+
+	h.publishEvent(EventRouteChanged, &candidate.Machine)
+
+	return h.RequestMapUpdates(candidate.Machine.NamespaceID)
+}
+
+// isBetterPrimary reports whether candidate should be preferred as Primary over current.
+func isBetterPrimary(candidate, current Route) bool {
+	if candidate.Metric != current.Metric {
+		return candidate.Metric < current.Metric
+	}
+
+	candidateSeen := routeLastSeen(candidate)
+	currentSeen := routeLastSeen(current)
+
+	if candidateSeen == nil {
+		return false
+	}
+	if currentSeen == nil {
+		return true
+	}
+
+	return candidateSeen.After(*currentSeen)
+}
+
+// routeLastSeen returns route's own LastSeen if it has one (refreshed by
+// RefreshAdvertisedRoutes), falling back to its machine's LastSeen otherwise.
+func routeLastSeen(route Route) *time.Time {
+	if route.LastSeen != nil {
+		return route.LastSeen
+	}
+
+	return route.Machine.LastSeen
+}
+
+// RefreshAdvertisedRoutes reconciles every Route belonging to m against its current
+// Hostinfo.RoutableIPs: existing routes have Advertised (and, if still advertised,
+// LastSeen) updated, and any newly advertised prefix gets a new disabled Route. It is
+// intended to be called whenever a machine's Hostinfo changes, i.e. on every map poll.
+func (h *Headscale) RefreshAdvertisedRoutes(m *Machine) error {
+	advertised, err := m.GetAdvertisedRoutes()
+	if err != nil {
+		return err
+	}
+
+	existing, err := h.GetMachineRoutes(m)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	seen := make(map[string]bool, len(existing))
+
+	for index := range existing {
+		route := existing[index]
+		seen[route.Prefix] = true
+
+		route.Advertised = containsIpPrefixString(advertised, route.Prefix)
+		if route.Advertised {
+			route.LastSeen = &now
+		}
+
+		if err := h.db.Save(&route).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, prefix := range advertised {
+		if seen[prefix.String()] {
+			continue
+		}
+
+		route := Route{
+			MachineID:  m.ID,
+			Prefix:     prefix.String(),
+			Advertised: true,
+			LastSeen:   &now,
+		}
+		if err := h.db.Create(&route).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func containsIpPrefixString(prefixes []netaddr.IPPrefix, candidate string) bool {
+	for _, prefix := range prefixes {
+		if prefix.String() == candidate {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRouteFailovers scans every Route currently marked Primary and, if the machine
+// serving it has not been seen within grace, promotes another enabled route for the
+// same prefix in its place. It is intended to be called periodically, alongside the
+// ephemeral machine reaper.
+func (h *Headscale) checkRouteFailovers(grace time.Duration) error {
+	primaries := []Route{}
+	if err := h.db.Preload("Machine").Where("is_primary = ? AND enabled = ?", true, true).Find(&primaries).Error; err != nil {
+		return err
+	}
+
+	cutoff := time.Now().UTC().Add(-grace)
+
+	for index := range primaries {
+		route := primaries[index]
+
+		if route.Machine.lastActivity().After(cutoff) {
+			continue
+		}
+
+		prefix, err := route.IPPrefix()
+		if err != nil {
+			return err
+		}
+
+		route.Primary = false
+		if err := h.db.Save(&route).Error; err != nil {
+			return err
+		}
+
+		if err := h.promoteNextPrimary(prefix, route.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPrimaryRoutesByMachine returns, for every machine that is currently the primary
+// subnet router for at least one prefix, the list of prefixes it should have in its
+// peers' AllowedIPs. The result has the shape Machines.toNodes takes as primaryRoutes;
+// nothing in this package calls it.
+func (h *Headscale) getPrimaryRoutesByMachine() (map[uint64][]netaddr.IPPrefix, error) {
+	routes := []Route{}
+	if err := h.db.Where("is_primary = ? AND enabled = ?", true, true).Find(&routes).Error; err != nil {
+		return nil, err
+	}
+
+	byMachine := make(map[uint64][]netaddr.IPPrefix)
+	for _, route := range routes {
+		prefix, err := route.IPPrefix()
+		if err != nil {
+			return nil, err
+		}
+
+		byMachine[route.MachineID] = append(byMachine[route.MachineID], prefix)
+	}
+
+	return byMachine, nil
+}
+
+// RoutesToProto returns the advertised and enabled routes for m as their proto representation.
+func (h *Headscale) RoutesToProto(m *Machine) (*v1.Routes, error) {
+	advertisedRoutes, err := m.GetAdvertisedRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	enabled, err := h.GetMachineRoutes(m)
+	if err != nil {
+		return nil, err
+	}
+
+	enabledRoutes := make([]netaddr.IPPrefix, 0, len(enabled))
+	for _, route := range enabled {
+		if !route.Enabled {
+			continue
+		}
+
+		prefix, err := route.IPPrefix()
+		if err != nil {
+			return nil, err
+		}
+
+		enabledRoutes = append(enabledRoutes, prefix)
+	}
+
+	return &v1.Routes{
+		AdvertisedRoutes: ipPrefixToString(advertisedRoutes),
+		EnabledRoutes:    ipPrefixToString(enabledRoutes),
+	}, nil
+}
@@ -0,0 +1,48 @@
+package headscale
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsBetterPrimaryByMetric(t *testing.T) {
+	candidate := Route{Metric: 1}
+	current := Route{Metric: 2}
+
+	if !isBetterPrimary(candidate, current) {
+		t.Error("lower metric should be preferred regardless of LastSeen")
+	}
+	if isBetterPrimary(current, candidate) {
+		t.Error("higher metric should not be preferred")
+	}
+}
+
+func TestIsBetterPrimaryNeverSeenIsNotPreferredOverSeen(t *testing.T) {
+	seen := time.Now().UTC()
+	candidate := Route{Metric: 0} // never seen: no LastSeen, no Machine.LastSeen
+	current := Route{Metric: 0, LastSeen: &seen}
+
+	if isBetterPrimary(candidate, current) {
+		t.Error("a route that has never been seen should not be preferred over one that has")
+	}
+}
+
+func TestRouteFailoverCutoffDoesNotTreatNeverPolledMachineAsStale(t *testing.T) {
+	// Regression test: a machine that just registered and had EnableRoute called for it
+	// has LastSeen == nil until its first map poll. checkRouteFailovers must treat that
+	// as "seen at CreatedAt", not as "already stale", or every freshly enabled route would
+	// fail over on the very next tick. This checks lastActivity against the same cutoff
+	// checkRouteFailovers computes; it does not call checkRouteFailovers itself.
+	grace := 5 * time.Minute
+	cutoff := time.Now().UTC().Add(-grace)
+
+	freshMachine := Machine{CreatedAt: time.Now().UTC(), LastSeen: nil}
+	if freshMachine.lastActivity().Before(cutoff) {
+		t.Error("a machine registered moments ago must not be considered stale")
+	}
+
+	staleMachine := Machine{CreatedAt: time.Now().UTC().Add(-time.Hour), LastSeen: nil}
+	if !staleMachine.lastActivity().Before(cutoff) {
+		t.Error("a machine that registered an hour ago and was never polled must be considered stale")
+	}
+}
@@ -0,0 +1,80 @@
+package headscale
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/fatih/set"
+	"github.com/rs/zerolog/log"
+	"gorm.io/datatypes"
+)
+
+// GetForcedTags returns the ACL tags an admin has explicitly assigned to m via
+// `headscale nodes tag`, regardless of what the machine itself requests.
+func (m *Machine) GetForcedTags() []string {
+	if len(m.ForcedTags) == 0 {
+		return []string{}
+	}
+
+	data, err := m.ForcedTags.MarshalJSON()
+	if err != nil {
+		log.Error().Err(err).Str("machine", m.Name).Msg("Failed to marshal ForcedTags")
+
+		return []string{}
+	}
+
+	tags := []string{}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		log.Error().Err(err).Str("machine", m.Name).Msg("Failed to parse ForcedTags")
+
+		return []string{}
+	}
+
+	return tags
+}
+
+// SetForcedTags replaces the ACL tags forcibly assigned to m and pushes a map update
+// to its namespace so peers pick up the new tag set.
+func (h *Headscale) SetForcedTags(m *Machine, tags []string) error {
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+
+	m.ForcedTags = datatypes.JSON(data)
+	if err := h.db.Save(m).Error; err != nil {
+		return err
+	}
+
+	return h.RequestMapUpdates(m.NamespaceID)
+}
+
+// Tags returns the full set of ACL tags m should be treated as having: every
+// ForcedTags entry, plus any tag it requested via Hostinfo.RequestTags that its
+// namespace is a registered owner of according to policy's TagOwners. Requested tags
+// the namespace does not own are silently dropped, mirroring Tailscale's behaviour for
+// untrusted tag requests. A nil policy yields ForcedTags only.
+func (m Machine) Tags(policy *ACLPolicy) []string {
+	tagSet := set.New(set.ThreadSafe)
+	for _, tag := range m.GetForcedTags() {
+		tagSet.Add(tag)
+	}
+
+	if policy != nil {
+		if hostinfo, err := m.GetHostInfo(); err == nil {
+			for _, tag := range hostinfo.RequestTags {
+				if policy.TagOwners.IsOwnedBy(tag, m.Namespace.Name) {
+					tagSet.Add(tag)
+				}
+			}
+		}
+	}
+
+	tags := make([]string, tagSet.Size())
+	for index, tag := range tagSet.List() {
+		tags[index] = tag.(string)
+	}
+	sort.Strings(tags)
+
+	return tags
+}